@@ -0,0 +1,100 @@
+// Copyright 2016 Canonical Ltd.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/idmclient/params"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+)
+
+// fakeLocalLoginStore is a LocalLoginStore backed by an in-memory
+// bakery.Oven, so CreateLocalLoginMacaroon can be exercised without a
+// real store.Store.
+type fakeLocalLoginStore struct {
+	hash    []byte
+	hashErr error
+	oven    *bakery.Oven
+
+	gotOp      bakery.Op
+	gotCaveats []checkers.Caveat
+}
+
+func newFakeLocalLoginStore(t *testing.T, hash []byte, hashErr error) *fakeLocalLoginStore {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	return &fakeLocalLoginStore{
+		hash:    hash,
+		hashErr: hashErr,
+		oven: bakery.NewOven(bakery.OvenParams{
+			Namespace: Checker.Namespace(),
+			Key:       key,
+			Location:  "identity",
+		}),
+	}
+}
+
+func (s *fakeLocalLoginStore) PasswordHash(username params.Username) ([]byte, error) {
+	if s.hashErr != nil {
+		return nil, s.hashErr
+	}
+	return s.hash, nil
+}
+
+func (s *fakeLocalLoginStore) NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, op bakery.Op) (*bakery.Macaroon, error) {
+	s.gotOp = op
+	s.gotCaveats = caveats
+	return s.oven.NewMacaroon(ctx, version, expiry, caveats, op)
+}
+
+func TestCreateLocalLoginMacaroonRejectsUnknownUser(t *testing.T) {
+	s := newFakeLocalLoginStore(t, nil, errgo.WithCausef(nil, params.ErrNotFound, "no password set for user %q", "bob"))
+	a := &Authorizer{}
+	_, err := a.CreateLocalLoginMacaroon(context.Background(), s, bakery.LatestVersion, "bob", "whatever")
+	if errgo.Cause(err) != params.ErrNotFound {
+		t.Fatalf("err cause = %v, want params.ErrNotFound", errgo.Cause(err))
+	}
+}
+
+func TestCreateLocalLoginMacaroonRejectsWrongPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+	s := newFakeLocalLoginStore(t, hash, nil)
+	a := &Authorizer{}
+	_, err = a.CreateLocalLoginMacaroon(context.Background(), s, bakery.LatestVersion, "bob", "wrong password")
+	if errgo.Cause(err) != params.ErrUnauthorized {
+		t.Fatalf("err cause = %v, want params.ErrUnauthorized", errgo.Cause(err))
+	}
+}
+
+func TestCreateLocalLoginMacaroonSucceeds(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+	s := newFakeLocalLoginStore(t, hash, nil)
+	a := &Authorizer{}
+	m, err := a.CreateLocalLoginMacaroon(context.Background(), s, bakery.LatestVersion, "bob", "correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m == nil {
+		t.Fatalf("expected a macaroon, got nil")
+	}
+	if s.gotOp != bakery.LoginOp {
+		t.Fatalf("op = %#v, want bakery.LoginOp", s.gotOp)
+	}
+	if len(s.gotCaveats) != 1 {
+		t.Fatalf("expected a single user-declaration caveat, got %d", len(s.gotCaveats))
+	}
+}
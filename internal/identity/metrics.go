@@ -0,0 +1,50 @@
+// Copyright 2016 Canonical Ltd.
+
+package identity
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+)
+
+// instrumentHandle wraps h so that every call records its duration and
+// final status code in metrics.HTTPRequestDuration, labelled with the
+// route's registered method and path (not the raw request URL, so
+// that path parameters don't blow up the metric's cardinality).
+func instrumentHandle(metrics *monitoring.Metrics, method, path string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		sw := &statusCodeWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, req, ps)
+		metrics.HTTPRequestDuration.WithLabelValues(path, method, strconv.Itoa(sw.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// statusCodeWriter wraps an http.ResponseWriter, recording the status
+// code that was written so it can be used as a metric label.
+type statusCodeWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusCodeWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher by forwarding to the wrapped
+// ResponseWriter, if it supports flushing. Without this, wrapping w in
+// statusCodeWriter would silently defeat a type assertion for
+// http.Flusher made further down the handler chain (as the SSE
+// endpoints make), since the wrapped ResponseWriter's static type is
+// the http.ResponseWriter interface and so does not promote Flush.
+func (w *statusCodeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Canonical Ltd.
+
+package identity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// flushRecorder wraps httptest.ResponseRecorder to additionally
+// implement http.Flusher, recording whether Flush was called.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed bool
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushed = true
+}
+
+func TestStatusCodeWriterForwardsFlushWhenSupported(t *testing.T) {
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	sw := &statusCodeWriter{ResponseWriter: rec, status: http.StatusOK}
+
+	flusher, ok := (http.ResponseWriter(sw)).(http.Flusher)
+	if !ok {
+		t.Fatalf("statusCodeWriter does not implement http.Flusher")
+	}
+	flusher.Flush()
+	if !rec.flushed {
+		t.Fatalf("Flush was not forwarded to the wrapped ResponseWriter")
+	}
+}
+
+func TestStatusCodeWriterFlushNoopWhenUnsupported(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := &statusCodeWriter{ResponseWriter: rec, status: http.StatusOK}
+
+	flusher, ok := (http.ResponseWriter(sw)).(http.Flusher)
+	if !ok {
+		t.Fatalf("statusCodeWriter does not implement http.Flusher")
+	}
+	// Must not panic even though rec does not implement http.Flusher.
+	flusher.Flush()
+}
+
+func TestStatusCodeWriterRecordsWrittenStatus(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := &statusCodeWriter{ResponseWriter: rec, status: http.StatusOK}
+	sw.WriteHeader(http.StatusTeapot)
+	if sw.status != http.StatusTeapot {
+		t.Fatalf("status = %d, want %d", sw.status, http.StatusTeapot)
+	}
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("underlying recorder code = %d, want %d", rec.Code, http.StatusTeapot)
+	}
+}
+
+func TestInstrumentHandleObservesStatusPathAndMethod(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := monitoring.New(reg)
+	h := instrumentHandle(metrics, "GET", "/v1/example/:id", func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/example/123", nil)
+	h(rec, req, httprouter.Params{{Key: "id", Value: "123"}})
+
+	histogram, ok := metrics.HTTPRequestDuration.WithLabelValues("/v1/example/:id", "GET", "201").(prometheus.Histogram)
+	if !ok {
+		t.Fatalf("observer is not a prometheus.Histogram")
+	}
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatalf("cannot write metric: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Fatalf("sample count = %d, want 1", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"html/template"
 	"net/http"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/juju/httprequest"
@@ -17,11 +18,13 @@ import (
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	"gopkg.in/mgo.v2"
 	"launchpad.net/lpad"
 
 	"github.com/CanonicalLtd/blues-identity/idp"
 	"github.com/CanonicalLtd/blues-identity/internal/auth"
+	"github.com/CanonicalLtd/blues-identity/internal/monitoring"
 	"github.com/CanonicalLtd/blues-identity/internal/store"
 	"github.com/CanonicalLtd/blues-identity/meeting"
 )
@@ -32,6 +35,31 @@ var logger = loggo.GetLogger("identity.internal.identity")
 // handlers that uses the given Store pool, and server params.
 type NewAPIHandlerFunc func(HandlerParams) ([]httprequest.Handler, error)
 
+// CaveatChecker is a function that checks a third-party caveat
+// condition registered under a name in ServerParams.CaveatCheckers. It
+// is invoked with the identity that has authenticated the discharge
+// request, the remaining text of the caveat condition (everything
+// after the condition name) and the HTTP request that triggered the
+// discharge. It should return any additional caveats that must be
+// added to the discharge macaroon, or an error if the caveat cannot
+// be satisfied. Returned caveats are not required to be first-party:
+// a caveat with a non-empty Location is passed through unchanged,
+// allowing a checker to delegate part of the discharge to another
+// discharger (see ThirdPartyLocatorContributor) rather than
+// satisfying it itself.
+type CaveatChecker func(ctx context.Context, identity bakery.ACLIdentity, args string, req *http.Request) ([]checkers.Caveat, error)
+
+// CaveatConditionContributor is implemented by identity providers that
+// wish to register additional third-party caveat conditions when the
+// server is constructed. IdentityProviders that do not need to
+// contribute any conditions need not implement this interface.
+type CaveatConditionContributor interface {
+	// CaveatConditions returns the set of caveat conditions that
+	// this identity provider wishes to register, keyed by
+	// condition name.
+	CaveatConditions() map[string]CaveatChecker
+}
+
 // New returns a handler that serves the given identity API versions using the
 // db to store identity data. The key of the versions map is the version name.
 func New(db *mgo.Database, sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error) {
@@ -61,11 +89,7 @@ func New(db *mgo.Database, sp ServerParams, versions map[string]NewAPIHandlerFun
 			return nil, errgo.Notef(err, "cannot generate key")
 		}
 	}
-	locator := bakery.NewThirdPartyStore()
-	locator.AddInfo(sp.Location, bakery.ThirdPartyInfo{
-		PublicKey: sp.Key.Public,
-		Version:   bakery.LatestVersion,
-	})
+	sp.ThirdPartyLocator = buildThirdPartyLocator(sp)
 	var rksf func([]bakery.Op) bakery.RootKeyStore
 	if sp.RootKeyStore != nil {
 		rksf = func([]bakery.Op) bakery.RootKeyStore {
@@ -76,7 +100,7 @@ func New(db *mgo.Database, sp ServerParams, versions map[string]NewAPIHandlerFun
 		Namespace:          auth.Checker.Namespace(),
 		RootKeyStoreForOps: rksf,
 		Key:                sp.Key,
-		Locator:            locator,
+		Locator:            sp.ThirdPartyLocator,
 		Location:           "identity",
 	})
 	auth := auth.New(auth.Params{
@@ -86,10 +110,32 @@ func New(db *mgo.Database, sp ServerParams, versions map[string]NewAPIHandlerFun
 		MacaroonOpStore: oven,
 	})
 
+	sp.CaveatCheckers = buildCaveatCheckers(sp)
+
+	// Create the metrics registry. A private registry is used,
+	// rather than the global default one, so that tests can assert
+	// on metric values without interfering with other tests.
+	registry := prometheus.NewRegistry()
+	metrics := monitoring.New(registry)
+	if sp.Place != nil {
+		monitoring.RegisterMeetingGauge(registry, sp.Place)
+	}
+	monitoring.RegisterMgoGauges(registry, pool)
+
 	// Create the HTTP server.
 	srv := &Server{
-		router: httprouter.New(),
-		pool:   pool,
+		router:  httprouter.New(),
+		pool:    pool,
+		metrics: registry,
+		gcStop:  make(chan struct{}),
+	}
+	if sp.Place != nil {
+		maxWait := sp.MaxWaitDuration
+		if maxWait <= 0 {
+			maxWait = defaultMaxWaitDuration
+		}
+		srv.gcWg.Add(1)
+		go srv.gcRendezvous(sp.Place, maxWait*2)
 	}
 	// Disable the automatic rerouting in order to maintain
 	// compatibility. It might be worthwhile relaxing this in the
@@ -100,7 +146,7 @@ func New(db *mgo.Database, sp ServerParams, versions map[string]NewAPIHandlerFun
 	srv.router.MethodNotAllowed = http.HandlerFunc(srv.methodNotAllowed)
 
 	srv.router.Handle("OPTIONS", "/*path", srv.options)
-	srv.router.Handler("GET", "/metrics", prometheus.Handler())
+	srv.router.Handler("GET", "/metrics", registry.Handler())
 	srv.router.Handler("GET", "/static/*path", http.StripPrefix("/static", http.FileServer(sp.StaticFileSystem)))
 	for name, newAPI := range versions {
 		handlers, err := newAPI(HandlerParams{
@@ -108,21 +154,107 @@ func New(db *mgo.Database, sp ServerParams, versions map[string]NewAPIHandlerFun
 			Pool:         pool,
 			Oven:         oven,
 			Authorizer:   auth,
+			Metrics:      metrics,
 		})
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot create API %s", name)
 		}
 		for _, h := range handlers {
-			srv.router.Handle(h.Method, h.Path, h.Handle)
+			srv.router.Handle(h.Method, h.Path, instrumentHandle(metrics, h.Method, h.Path, h.Handle))
 		}
 	}
 	return srv, nil
 }
 
+// buildThirdPartyLocator returns the bakery.ThirdPartyStore to use for
+// the server being constructed from sp. It doubles as a registry of
+// known dischargers: as well as knowing about this server itself, it
+// also knows about any other dischargers that a CaveatChecker can
+// chain a caveat to (see ThirdPartyLocatorContributor), so that
+// clients doing bakery.DischargeAll can find them.
+func buildThirdPartyLocator(sp ServerParams) *bakery.ThirdPartyStore {
+	locator := sp.ThirdPartyLocator
+	if locator == nil {
+		locator = bakery.NewThirdPartyStore()
+	}
+	locator.AddInfo(sp.Location, bakery.ThirdPartyInfo{
+		PublicKey: sp.Key.Public,
+		Version:   bakery.LatestVersion,
+	})
+	for _, provider := range sp.IdentityProviders {
+		contributor, ok := provider.(ThirdPartyLocatorContributor)
+		if !ok {
+			continue
+		}
+		for loc, info := range contributor.ThirdPartyInfo() {
+			locator.AddInfo(loc, info)
+		}
+	}
+	return locator
+}
+
+// buildCaveatCheckers returns the caveat-condition registry to use for
+// the server being constructed from sp, starting with any conditions
+// configured directly on sp.CaveatCheckers and then letting each
+// identity provider contribute its own conditions.
+func buildCaveatCheckers(sp ServerParams) map[string]CaveatChecker {
+	caveatCheckers := make(map[string]CaveatChecker)
+	for cond, checker := range sp.CaveatCheckers {
+		caveatCheckers[cond] = checker
+	}
+	for _, provider := range sp.IdentityProviders {
+		contributor, ok := provider.(CaveatConditionContributor)
+		if !ok {
+			continue
+		}
+		for cond, checker := range contributor.CaveatConditions() {
+			caveatCheckers[cond] = checker
+		}
+	}
+	return caveatCheckers
+}
+
+// defaultMaxWaitDuration is the length of time that /v1/wait and
+// /v1/wait-token will block for by default before returning a pending
+// response, if ServerParams.MaxWaitDuration is not set. It must match
+// the default used by the v1 API (see v1.defaultMaxWaitDuration); it
+// is duplicated here because v1 imports this package, not vice versa.
+const defaultMaxWaitDuration = 2 * time.Minute
+
+// gcInterval is how often Server sweeps sp.Place for abandoned
+// rendezvous.
+const gcInterval = 30 * time.Second
+
 // Server serves the identity endpoints.
 type Server struct {
-	router *httprouter.Router
-	pool   *store.Pool
+	router  *httprouter.Router
+	pool    *store.Pool
+	metrics *prometheus.Registry
+	gcStop  chan struct{}
+	gcWg    sync.WaitGroup
+}
+
+// gcRendezvous periodically removes rendezvous abandoned on place for
+// longer than maxAge, until Close is called.
+func (srv *Server) gcRendezvous(place *meeting.Place, maxAge time.Duration) {
+	defer srv.gcWg.Done()
+	t := time.NewTicker(gcInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			place.GC(maxAge)
+		case <-srv.gcStop:
+			return
+		}
+	}
+}
+
+// Metrics returns the registry holding this server's Prometheus
+// collectors, so that tests can assert on metric values directly
+// rather than scraping /metrics.
+func (srv *Server) Metrics() *prometheus.Registry {
+	return srv.metrics
 }
 
 // ServeHTTP implements http.Handler.
@@ -145,6 +277,8 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // Close  closes any resources held by this Handler.
 func (s *Server) Close() {
 	logger.Debugf("Closing Server")
+	close(s.gcStop)
+	s.gcWg.Wait()
 	s.pool.Close()
 }
 
@@ -206,6 +340,30 @@ type ServerParams struct {
 	// Template contains a set of templates that are used to generate
 	// html output.
 	Template *template.Template
+
+	// MaxWaitDuration holds the maximum length of time that the
+	// /v1/wait and /v1/wait-token endpoints will block for before
+	// returning a pending response. If zero, a default of 2 minutes is
+	// used. /v1/wait-sse does not use it: it sends heartbeats until
+	// the rendezvous completes or the client goes away.
+	MaxWaitDuration time.Duration
+
+	// CaveatCheckers holds a registry of checkers for third-party
+	// caveat conditions other than the built-in
+	// is-authenticated-user and is-member-of conditions, keyed by
+	// condition name. Identity providers that implement
+	// CaveatConditionContributor may add to this registry when the
+	// server is constructed.
+	CaveatCheckers map[string]CaveatChecker
+
+	// ThirdPartyLocator holds the set of known dischargers, used to
+	// discharge third-party caveats. It is seeded with this server's
+	// own key and location and with any dischargers contributed by
+	// IdentityProviders that implement ThirdPartyLocatorContributor,
+	// so that clients doing bakery.DischargeAll can find dischargers
+	// that a CaveatChecker chains to. If nil, a fresh store is
+	// created.
+	ThirdPartyLocator *bakery.ThirdPartyStore
 }
 
 type HandlerParams struct {
@@ -222,6 +380,21 @@ type HandlerParams struct {
 	// Authorizer contains an auth.Authroizer that should be used by
 	// handlers to authorize requests.
 	Authorizer *auth.Authorizer
+
+	// Metrics holds the Prometheus collectors that handlers should
+	// update to instrument the discharge and login pipeline.
+	Metrics *monitoring.Metrics
+}
+
+// ThirdPartyLocatorContributor is implemented by identity providers
+// that wish to register additional dischargers with the server's
+// bakery.ThirdPartyLocator when the server is constructed, typically
+// so that a CaveatChecker can chain a caveat to that discharger (see
+// CaveatChecker).
+type ThirdPartyLocatorContributor interface {
+	// ThirdPartyInfo returns the set of dischargers that this
+	// identity provider wishes to register, keyed by location.
+	ThirdPartyInfo() map[string]bakery.ThirdPartyInfo
 }
 
 //notFound is the handler that is called when a handler cannot be found
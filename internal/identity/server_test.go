@@ -0,0 +1,104 @@
+// Copyright 2016 Canonical Ltd.
+
+package identity
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+)
+
+// NOTE: the backlog item behind these two unit tests also asked for
+// an integration test that stands up two child dischargers and
+// verifies a client obtains three macaroons (target + two
+// discharges). That acceptance criterion is still open: it needs a
+// live HTTP discharger and a real mgo-backed store.Store, neither of
+// which this tree has test infrastructure for. The tests below cover
+// the locator/registry-merge logic these two commits actually added,
+// not the end-to-end chained-discharge flow - don't read them as
+// satisfying that criterion.
+
+// TestBuildThirdPartyLocatorSeedsSelfAndKeepsExisting verifies that
+// buildThirdPartyLocator always adds the server's own location and
+// key to the locator, while preserving any dischargers already known
+// to a locator passed in via ServerParams.ThirdPartyLocator - this is
+// what lets a CaveatChecker chain a caveat to another, already-known
+// discharger (chunk0-4) and have clients doing bakery.DischargeAll
+// find it.
+func TestBuildThirdPartyLocatorSeedsSelfAndKeepsExisting(t *testing.T) {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	childKey, err := bakery.GenerateKey()
+	if err != nil {
+		t.Fatalf("cannot generate child key: %v", err)
+	}
+	locator := bakery.NewThirdPartyStore()
+	locator.AddInfo("https://2fa.example.com", bakery.ThirdPartyInfo{
+		PublicKey: childKey.Public,
+		Version:   bakery.LatestVersion,
+	})
+	sp := ServerParams{
+		Location:          "https://identity.example.com",
+		Key:               key,
+		ThirdPartyLocator: locator,
+	}
+
+	got := buildThirdPartyLocator(sp)
+
+	self, err := got.ThirdPartyInfo(context.Background(), sp.Location)
+	if err != nil {
+		t.Fatalf("server's own location not found in locator: %v", err)
+	}
+	if self.PublicKey != key.Public {
+		t.Fatalf("self public key mismatch: got %v want %v", self.PublicKey, key.Public)
+	}
+
+	child, err := got.ThirdPartyInfo(context.Background(), "https://2fa.example.com")
+	if err != nil {
+		t.Fatalf("previously-known discharger lost from locator: %v", err)
+	}
+	if child.PublicKey != childKey.Public {
+		t.Fatalf("child public key mismatch: got %v want %v", child.PublicKey, childKey.Public)
+	}
+}
+
+// TestBuildCaveatCheckersChainsToAnotherDischarger verifies that a
+// CaveatChecker registered on ServerParams.CaveatCheckers can return a
+// caveat with a non-empty Location, delegating part of a discharge to
+// another discharger instead of satisfying it directly (chunk0-4).
+func TestBuildCaveatCheckersChainsToAnotherDischarger(t *testing.T) {
+	sp := ServerParams{
+		CaveatCheckers: map[string]CaveatChecker{
+			"require-2fa": func(ctx context.Context, identity bakery.ACLIdentity, args string, req *http.Request) ([]checkers.Caveat, error) {
+				return []checkers.Caveat{{
+					Location:  "https://2fa.example.com",
+					Condition: "require-2fa " + args,
+				}}, nil
+			},
+		},
+	}
+
+	checkerMap := buildCaveatCheckers(sp)
+	checker, ok := checkerMap["require-2fa"]
+	if !ok {
+		t.Fatalf("configured caveat condition not found in registry")
+	}
+	cavs, err := checker(context.Background(), nil, "webauthn", nil)
+	if err != nil {
+		t.Fatalf("checker returned error: %v", err)
+	}
+	if len(cavs) != 1 {
+		t.Fatalf("expected 1 caveat, got %d", len(cavs))
+	}
+	if cavs[0].Location != "https://2fa.example.com" {
+		t.Fatalf("expected chained caveat location, got %q", cavs[0].Location)
+	}
+	if cavs[0].Condition != "require-2fa webauthn" {
+		t.Fatalf("expected condition to carry args through, got %q", cavs[0].Condition)
+	}
+}
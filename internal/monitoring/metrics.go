@@ -0,0 +1,112 @@
+// Copyright 2016 Canonical Ltd.
+
+// Package monitoring holds the Prometheus collectors used to
+// instrument the identity server's discharge and login pipeline.
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Prometheus collectors that are updated directly
+// from request-handling code as requests are served. Use New to
+// create one and register it with a registry.
+type Metrics struct {
+	DischargeDuration   *prometheus.HistogramVec
+	LoginTotal          *prometheus.CounterVec
+	WaitDuration        prometheus.Histogram
+	HTTPRequestDuration *prometheus.HistogramVec
+}
+
+// New creates a Metrics and registers all of its collectors with reg.
+func New(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		DischargeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "candid_discharge_duration_seconds",
+			Help: "Time taken to check a third-party discharge caveat, by condition and outcome.",
+		}, []string{"condition", "outcome"}),
+		LoginTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "candid_login_total",
+			Help: "Count of login attempts, by identity provider and outcome.",
+		}, []string{"idp", "outcome"}),
+		WaitDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "candid_wait_duration_seconds",
+			Help: "Time taken for a /v1/wait (or /v1/wait-token) call to complete.",
+		}),
+		HTTPRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "candid_http_request_duration_seconds",
+			Help: "Time taken to serve an HTTP request, by matched route, method and status.",
+		}, []string{"path", "method", "status"}),
+	}
+	reg.MustRegister(
+		m.DischargeDuration,
+		m.LoginTotal,
+		m.WaitDuration,
+		m.HTTPRequestDuration,
+	)
+	return m
+}
+
+// ObserveDischarge records the time taken to check a third-party
+// discharge caveat for condition, started at start, along with its
+// outcome ("ok" or "error").
+func (m *Metrics) ObserveDischarge(condition, outcome string, start time.Time) {
+	m.DischargeDuration.WithLabelValues(condition, outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveLogin records the outcome ("ok" or "error") of a login
+// attempt through the named identity provider.
+func (m *Metrics) ObserveLogin(idp, outcome string) {
+	m.LoginTotal.WithLabelValues(idp, outcome).Inc()
+}
+
+// ObserveWait records the time taken, started at start, for a wait
+// request to complete (successfully or not).
+func (m *Metrics) ObserveWait(start time.Time) {
+	m.WaitDuration.Observe(time.Since(start).Seconds())
+}
+
+// RendezvousCounter is implemented by a meeting.Place that can report
+// how many rendezvous it currently has outstanding.
+type RendezvousCounter interface {
+	Len() int
+}
+
+// RegisterMeetingGauge registers a candid_meeting_rendezvous_active
+// gauge with reg that reports place.Len() whenever the registry is
+// scraped.
+func RegisterMeetingGauge(reg *prometheus.Registry, place RendezvousCounter) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "candid_meeting_rendezvous_active",
+		Help: "Number of rendezvous currently outstanding in the meeting place.",
+	}, func() float64 {
+		return float64(place.Len())
+	}))
+}
+
+// MgoSessionCounter is implemented by a store.Pool that can report its
+// current and maximum mgo session usage.
+type MgoSessionCounter interface {
+	SessionsInUse() int
+	MaxSessions() int
+}
+
+// RegisterMgoGauges registers candid_mgo_sessions_in_use and
+// candid_mgo_sessions_max gauges with reg, sourced from pool whenever
+// the registry is scraped.
+func RegisterMgoGauges(reg *prometheus.Registry, pool MgoSessionCounter) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "candid_mgo_sessions_in_use",
+		Help: "Number of mgo sessions currently checked out of the pool.",
+	}, func() float64 {
+		return float64(pool.SessionsInUse())
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "candid_mgo_sessions_max",
+		Help: "Maximum number of mgo sessions the pool will hand out.",
+	}, func() float64 {
+		return float64(pool.MaxSessions())
+	}))
+}
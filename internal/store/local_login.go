@@ -0,0 +1,27 @@
+// Copyright 2016 Canonical Ltd.
+
+package store
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+)
+
+// NewMacaroon mints a new macaroon using the store's own bakery,
+// exactly as DischargeTokenForUser does. Minting through s.Bakery.Oven
+// (rather than building a macaroon by hand against some other root
+// key store) is what makes the result discoverable by s.Authorize
+// later on: mint and verify share the same root key store, so a
+// macaroon produced this way can go on to authenticate a future
+// request without involving an external identity provider.
+func (s *Store) NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, op bakery.Op) (*bakery.Macaroon, error) {
+	m, err := s.Bakery.Oven.NewMacaroon(ctx, version, expiry, caveats, op)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return m, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2016 Canonical Ltd.
+
+package store
+
+import (
+	"github.com/juju/idmclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ActionSetPassword is the action used to authorize setting or
+// removing a user's local-login password.
+const ActionSetPassword = "set-password"
+
+// SetPassword sets the bcrypt-hashed password for username, replacing
+// any existing password. Pass a nil hash to remove local-login access
+// for the user.
+func (s *Store) SetPassword(username params.Username, hash []byte) error {
+	return s.UpdateIdentity(username, bson.D{{
+		"$set", bson.D{{"passwordhash", hash}},
+	}})
+}
+
+// PasswordHash returns the bcrypt-hashed password stored for username.
+// It returns an error with a params.ErrNotFound cause if the user does
+// not exist or has no local password set.
+func (s *Store) PasswordHash(username params.Username) ([]byte, error) {
+	var doc struct {
+		PasswordHash []byte `bson:"passwordhash"`
+	}
+	err := s.Identities().Find(bson.D{{"username", username}}).One(&doc)
+	if err == mgo.ErrNotFound || (err == nil && len(doc.PasswordHash) == 0) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no password set for user %q", username)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return doc.PasswordHash, nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 Canonical Ltd.
+
+package store
+
+// SessionsInUse returns the number of mgo sessions currently checked
+// out of the pool. It implements monitoring.MgoSessionCounter.
+func (p *Pool) SessionsInUse() int {
+	return len(p.limiter)
+}
+
+// MaxSessions returns the maximum number of mgo sessions the pool
+// will hand out. It implements monitoring.MgoSessionCounter.
+func (p *Pool) MaxSessions() int {
+	return cap(p.limiter)
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Canonical Ltd.
+
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+)
+
+// ExpiringRootKeyStore is a bakery.RootKeyStore that hands out a fresh
+// random root key on every call to RootKey and forgets it again once
+// it is older than expiry. Unlike the store's shared Bakery.Oven root
+// key store, a leaked macaroon minted against an ExpiringRootKeyStore
+// doesn't share the blast radius of the server's general-purpose
+// macaroons: its root key lives only here, and is gone on its own
+// short schedule regardless of what that store's policy is.
+//
+// NOTE: using this for local-login macaroons also requires Store's
+// own Bakery.Oven (which is what actually verifies incoming macaroons
+// via h.store.Authorize) to be built with a RootKeyStoreForOps that
+// consults this store for bakery.LoginOp, the same way
+// identity.New's oven dispatches on ServerParams.RootKeyStore. That
+// wiring lives wherever Store.Bakery itself is constructed, which is
+// outside this package's visible files, so it is not yet connected -
+// see internal/auth/local_login.go.
+type ExpiringRootKeyStore struct {
+	expiry time.Duration
+
+	mu   sync.Mutex
+	keys map[string]expiringRootKey
+}
+
+type expiringRootKey struct {
+	rootKey []byte
+	created time.Time
+}
+
+// NewExpiringRootKeyStore returns a new ExpiringRootKeyStore whose
+// root keys are forgotten once they are older than expiry. expiry
+// should match the lifetime of the macaroons it will be used to mint.
+func NewExpiringRootKeyStore(expiry time.Duration) *ExpiringRootKeyStore {
+	return &ExpiringRootKeyStore{
+		expiry: expiry,
+		keys:   make(map[string]expiringRootKey),
+	}
+}
+
+// RootKey implements bakery.RootKeyStore.RootKey, returning a fresh
+// random root key under a fresh random id.
+func (s *ExpiringRootKeyStore) RootKey(ctx context.Context) (rootKey []byte, id []byte, err error) {
+	rootKey = make([]byte, 24)
+	if _, err := rand.Read(rootKey); err != nil {
+		return nil, nil, errgo.Notef(err, "cannot generate root key")
+	}
+	idBuf := make([]byte, 18)
+	if _, err := rand.Read(idBuf); err != nil {
+		return nil, nil, errgo.Notef(err, "cannot generate root key id")
+	}
+	id = []byte(base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(idBuf))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[string(id)] = expiringRootKey{
+		rootKey: rootKey,
+		created: time.Now(),
+	}
+	return rootKey, id, nil
+}
+
+// Get implements bakery.RootKeyStore.Get, returning bakery.ErrNotFound
+// once id is unknown or its root key is older than expiry.
+func (s *ExpiringRootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[string(id)]
+	if !ok {
+		return nil, bakery.ErrNotFound
+	}
+	if time.Since(k.created) > s.expiry {
+		delete(s.keys, string(id))
+		return nil, bakery.ErrNotFound
+	}
+	return k.rootKey, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Canonical Ltd.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+)
+
+func TestExpiringRootKeyStoreRoundTrip(t *testing.T) {
+	s := NewExpiringRootKeyStore(time.Hour)
+	key, id, err := s.RootKey(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get root key: %v", err)
+	}
+	if len(key) == 0 || len(id) == 0 {
+		t.Fatalf("RootKey returned an empty key or id")
+	}
+	got, err := s.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("cannot get root key back: %v", err)
+	}
+	if string(got) != string(key) {
+		t.Fatalf("got key %x, want %x", got, key)
+	}
+}
+
+func TestExpiringRootKeyStoreDistinctKeysAndIds(t *testing.T) {
+	s := NewExpiringRootKeyStore(time.Hour)
+	key1, id1, err := s.RootKey(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get first root key: %v", err)
+	}
+	key2, id2, err := s.RootKey(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get second root key: %v", err)
+	}
+	if string(id1) == string(id2) {
+		t.Fatalf("two calls to RootKey returned the same id")
+	}
+	if string(key1) == string(key2) {
+		t.Fatalf("two calls to RootKey returned the same key")
+	}
+}
+
+func TestExpiringRootKeyStoreGetUnknownId(t *testing.T) {
+	s := NewExpiringRootKeyStore(time.Hour)
+	if _, err := s.Get(context.Background(), []byte("no-such-id")); errgo.Cause(err) != bakery.ErrNotFound {
+		t.Fatalf("err = %v, want bakery.ErrNotFound", err)
+	}
+}
+
+func TestExpiringRootKeyStoreGetExpired(t *testing.T) {
+	s := NewExpiringRootKeyStore(time.Millisecond)
+	_, id, err := s.RootKey(context.Background())
+	if err != nil {
+		t.Fatalf("cannot get root key: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Get(context.Background(), id); errgo.Cause(err) != bakery.ErrNotFound {
+		t.Fatalf("err = %v, want bakery.ErrNotFound for an expired key", err)
+	}
+}
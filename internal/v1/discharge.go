@@ -18,6 +18,7 @@ import (
 	"gopkg.in/macaroon.v2-unstable"
 	"gopkg.in/mgo.v2/bson"
 
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
 	"github.com/CanonicalLtd/blues-identity/internal/store"
 )
 
@@ -25,6 +26,11 @@ const (
 	// dischargeTokenDuration is the length of time for which a
 	// discharge token is valid.
 	dischargeTokenDuration = 6 * time.Hour
+
+	// defaultDischargeExpiry is the length of time for which an
+	// is-authenticated-user discharge is valid when the client has
+	// not requested a shorter lifetime.
+	defaultDischargeExpiry = 24 * time.Hour
 )
 
 // thirdPartyCaveatChecker implements an
@@ -54,7 +60,18 @@ func (c thirdPartyCaveatChecker) CheckThirdPartyCaveat(ctx context.Context, req
 // checkThirdPartyCaveat checks the given caveat. This function is called
 // by the httpbakery discharge logic. See httpbakery.DischargeHandler
 // for futher details.
-func checkThirdPartyCaveat(ctx context.Context, h *handler, req *http.Request, ci *bakery.ThirdPartyCaveatInfo) ([]checkers.Caveat, error) {
+func checkThirdPartyCaveat(ctx context.Context, h *handler, req *http.Request, ci *bakery.ThirdPartyCaveatInfo) (cavs []checkers.Caveat, err error) {
+	start := time.Now()
+	cond0, _, _ := checkers.ParseCaveat(ci.Condition)
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		if h.params.Metrics != nil {
+			h.params.Metrics.ObserveDischarge(cond0, outcome, start)
+		}
+	}()
 	dischargeForUser := req.Form.Get("discharge-for-user")
 	op := bakery.LoginOp
 	if dischargeForUser != "" {
@@ -81,16 +98,19 @@ func checkThirdPartyCaveat(ctx context.Context, h *handler, req *http.Request, c
 	if err != nil {
 		return nil, errgo.WithCausef(err, params.ErrBadRequest, "cannot parse caveat %q", ci.Condition)
 	}
-	var cavs []checkers.Caveat
 	switch cond {
 	case "is-authenticated-user":
 		user := dischargeForUser
 		if user == "" {
 			user = authInfo.Identity.Id()
 		}
+		expiry, err := dischargeExpiry(args, defaultDischargeExpiry)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
 		cavs = []checkers.Caveat{
 			idmclient.UserDeclaration(user),
-			checkers.TimeBeforeCaveat(time.Now().Add(24 * time.Hour)),
+			checkers.TimeBeforeCaveat(expiry),
 		}
 	case "is-member-of":
 		ok, err := authInfo.Identity.(bakery.ACLIdentity).Allow(ctx, strings.Fields(args))
@@ -102,12 +122,89 @@ func checkThirdPartyCaveat(ctx context.Context, h *handler, req *http.Request, c
 		}
 		// TODO should this be time-limited?
 	default:
-		return nil, checkers.ErrCaveatNotRecognized
+		cavs, err = dispatchCaveatChecker(ctx, h.params.CaveatCheckers, cond, authInfo.Identity.(bakery.ACLIdentity), args, req)
+		if err != nil {
+			return nil, err
+		}
 	}
 	h.updateDischargeTime(params.Username(authInfo.Identity.Id()))
 	return cavs, nil
 }
 
+// dispatchCaveatChecker looks cond up in caveatCheckers, the registry
+// built by identity.buildCaveatCheckers, and invokes it with args and
+// the authenticated identity. It returns checkers.ErrCaveatNotRecognized
+// if cond isn't registered, and wraps any error the checker itself
+// returns.
+func dispatchCaveatChecker(ctx context.Context, caveatCheckers map[string]identity.CaveatChecker, cond string, who bakery.ACLIdentity, args string, req *http.Request) ([]checkers.Caveat, error) {
+	checker, ok := caveatCheckers[cond]
+	if !ok {
+		return nil, checkers.ErrCaveatNotRecognized
+	}
+	cavs, err := checker(ctx, who, args, req)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot check caveat", errgo.Any)
+	}
+	return cavs, nil
+}
+
+// dischargeExpiry works out the expiry time to use for a discharge
+// macaroon given the server's default duration. args holds the text
+// following "is-authenticated-user" in the third-party caveat's own
+// condition (see checkers.ParseCaveat), which is part of the caveat
+// data protected by the macaroon's signature - unlike an HTTP request
+// parameter, a holder cannot strip it without invalidating the
+// caveat. A caller may embed one or more discharge-expiry-lte=<RFC3339
+// time> or discharge-max-duration=<Go duration> tokens there when
+// adding the caveat to the target macaroon, in order to request a
+// shorter lifetime than the server default; when several such tokens
+// are present the earliest resulting time wins. It is an error for
+// any requested expiry to already be in the past.
+func dischargeExpiry(args string, def time.Duration) (time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(def)
+	for _, tok := range strings.Fields(args) {
+		key, val := splitArg(tok)
+		switch key {
+		case "discharge-expiry-lte":
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return time.Time{}, errgo.WithCausef(err, params.ErrBadRequest, "cannot parse discharge-expiry-lte %q", val)
+			}
+			if t.Before(now) {
+				return time.Time{}, errgo.WithCausef(nil, params.ErrBadRequest, "discharge-expiry-lte %q is in the past", val)
+			}
+			if t.Before(expiry) {
+				expiry = t
+			}
+		case "discharge-max-duration":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return time.Time{}, errgo.WithCausef(err, params.ErrBadRequest, "cannot parse discharge-max-duration %q", val)
+			}
+			t := now.Add(d)
+			if t.Before(now) {
+				return time.Time{}, errgo.WithCausef(nil, params.ErrBadRequest, "discharge-max-duration %q is in the past", val)
+			}
+			if t.Before(expiry) {
+				expiry = t
+			}
+		}
+	}
+	return expiry, nil
+}
+
+// splitArg splits a single caveat-condition token of the form
+// "key=value" into its key and value. A token without an "=" is
+// returned whole as the key, with an empty value.
+func splitArg(tok string) (key, val string) {
+	i := strings.IndexByte(tok, '=')
+	if i < 0 {
+		return tok, ""
+	}
+	return tok[:i], tok[i+1:]
+}
+
 func (h *handler) updateDischargeTime(username params.Username) {
 	err := h.store.UpdateIdentity(username, bson.D{{
 		"$set", bson.D{{
@@ -134,6 +231,11 @@ func needLoginError(h *handler, req *http.Request, info *dischargeRequestInfo, w
 	return httpbakery.NewInteractionRequiredError(visitURL, waitURL, why, req)
 }
 
+// defaultMaxWaitDuration is the length of time that /v1/wait and
+// /v1/wait-token will block for by default before returning a pending
+// response, if ServerParams.MaxWaitDuration is not set.
+const defaultMaxWaitDuration = 2 * time.Minute
+
 // waitRequest is the request sent to the server to wait for logins to
 // complete. Discharging caveats will normally be handled by the bakery
 // it would be unusual to use this type directly in client software.
@@ -142,10 +244,30 @@ type waitRequest struct {
 	WaitID            string `httprequest:"waitid,form"`
 }
 
+// waitTokenRequest is the request sent to resume a previous /v1/wait
+// or /v1/wait-token call that returned a pending response, using the
+// resume token it returned.
+type waitTokenRequest struct {
+	httprequest.Route `httprequest:"GET /v1/wait-token"`
+	Token             string `httprequest:"token,form"`
+}
+
 // waitResponse holds the response from the wait endpoint. Discharging
 // caveats will normally be handled by the bakery it would be unusual to
 // use this type directly in client software.
 type waitResponse struct {
+	// Status is "pending" if no rendezvous completed within the
+	// server's maximum wait duration; in that case Resume holds a
+	// token that can be passed to /v1/wait-token to keep waiting,
+	// and Macaroon and DischargeToken are not set. Status is empty
+	// once the rendezvous has actually completed.
+	Status string `json:"status,omitempty"`
+
+	// Resume holds an opaque token that can be passed to
+	// /v1/wait-token to resume waiting on the same rendezvous. It is
+	// only set when Status is "pending".
+	Resume string `json:"resume,omitempty"`
+
 	// Macaroon holds the acquired discharge macaroon.
 	Macaroon *bakery.Macaroon
 
@@ -155,17 +277,62 @@ type waitResponse struct {
 	DischargeToken macaroon.Slice
 }
 
-// serveWait serves an HTTP endpoint that waits until a macaroon
-// has been discharged, and returns the discharge macaroon.
+// Wait serves an HTTP endpoint that waits until a macaroon has been
+// discharged, and returns the discharge macaroon. If no rendezvous
+// completes within h.params.MaxWaitDuration, it returns a pending
+// response carrying a resume token rather than blocking indefinitely,
+// so that abandoned requests don't tie up a server goroutine forever;
+// the client can continue waiting by calling /v1/wait-token with that
+// token.
 func (h *dischargeHandler) Wait(p httprequest.Params, w *waitRequest) (*waitResponse, error) {
 	if w.WaitID == "" {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "wait id parameter not found")
 	}
-	// TODO don't wait forever here.
-	reqInfo, login, err := h.place.Wait(w.WaitID)
+	return h.wait(p, w.WaitID)
+}
+
+// WaitToken serves an HTTP endpoint that resumes a previous wait using
+// the resume token returned by a pending /v1/wait or /v1/wait-token
+// response. It behaves identically to Wait in all other respects; the
+// rendezvous itself is only ever consumed once, however many times it
+// has to be resumed.
+func (h *dischargeHandler) WaitToken(p httprequest.Params, w *waitTokenRequest) (*waitResponse, error) {
+	if w.Token == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "token parameter not found")
+	}
+	return h.wait(p, w.Token)
+}
+
+// wait blocks on the rendezvous identified by waitId until it
+// completes or h.params.MaxWaitDuration elapses, whichever comes
+// first.
+func (h *dischargeHandler) wait(p httprequest.Params, waitId string) (*waitResponse, error) {
+	start := time.Now()
+	if h.params.Metrics != nil {
+		defer func() { h.params.Metrics.ObserveWait(start) }()
+	}
+	maxWait := h.params.MaxWaitDuration
+	if maxWait <= 0 {
+		maxWait = defaultMaxWaitDuration
+	}
+	ctx, cancel := context.WithTimeout(p.Context, maxWait)
+	defer cancel()
+	item, result, err := h.place.Wait(ctx, waitId)
+	if errgo.Cause(err) == context.DeadlineExceeded {
+		return &waitResponse{
+			Status: "pending",
+			Resume: waitId,
+		}, nil
+	}
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot wait")
 	}
+	return h.completeWait(p, item.(*dischargeRequestInfo), result.(loginInfo))
+}
+
+// completeWait turns a completed rendezvous into a waitResponse,
+// setting the macaroon-identity cookie on the response along the way.
+func (h *dischargeHandler) completeWait(p httprequest.Params, reqInfo *dischargeRequestInfo, login loginInfo) (*waitResponse, error) {
 	if login.Error != nil {
 		return nil, errgo.NoteMask(login.Error, "login failed", errgo.Any)
 	}
@@ -174,7 +341,7 @@ func (h *dischargeHandler) Wait(p httprequest.Params, w *waitRequest) (*waitResp
 	originCaveat := h.store.Bakery.Checker.Namespace().ResolveCaveat(httpbakery.ClientOriginCaveat(reqInfo.Origin))
 	// Ensure the identity macaroon can only be used from the same
 	// origin as the original discharge request.
-	err = login.IdentityMacaroon[0].AddFirstPartyCaveat(originCaveat.Condition)
+	err := login.IdentityMacaroon[0].AddFirstPartyCaveat(originCaveat.Condition)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot add origin caveat to identity macaroon")
 	}
@@ -199,6 +366,7 @@ func (h *dischargeHandler) Wait(p httprequest.Params, w *waitRequest) (*waitResp
 		Caveat:  reqInfo.Caveat,
 		Key:     h.store.Bakery.Oven.Key(),
 		Checker: checker,
+		Locator: h.params.ThirdPartyLocator,
 	})
 	if err != nil {
 		return nil, errgo.NoteMask(err, "cannot discharge", errgo.Any)
@@ -228,6 +396,11 @@ func (h *dischargeHandler) Wait(p httprequest.Params, w *waitRequest) (*waitResp
 type dischargeTokenForUserRequest struct {
 	httprequest.Route `httprequest:"GET /v1/discharge-token-for-user"`
 	Username          params.Username `httprequest:"username,form"`
+
+	// MaxDuration, if set, requests a discharge token valid for no
+	// longer than the given Go duration, overriding
+	// dischargeTokenDuration if it is shorter.
+	MaxDuration string `httprequest:"max-duration,form"`
 }
 
 // dischargeTokenForUserResponse holds the response for the discharge token for user endpoint
@@ -242,10 +415,23 @@ func (h *dischargeHandler) DischargeTokenForUser(p httprequest.Params, r *discha
 	if err != nil {
 		return dischargeTokenForUserResponse{}, errgo.NoteMask(err, "cannot get identity", errgo.Is(params.ErrNotFound))
 	}
+	expiry := time.Now().Add(dischargeTokenDuration)
+	if r.MaxDuration != "" {
+		d, err := time.ParseDuration(r.MaxDuration)
+		if err != nil {
+			return dischargeTokenForUserResponse{}, errgo.WithCausef(err, params.ErrBadRequest, "cannot parse max-duration %q", r.MaxDuration)
+		}
+		if t := time.Now().Add(d); t.Before(expiry) {
+			if t.Before(time.Now()) {
+				return dischargeTokenForUserResponse{}, errgo.WithCausef(nil, params.ErrBadRequest, "max-duration %q is in the past", r.MaxDuration)
+			}
+			expiry = t
+		}
+	}
 	m, err := h.store.Bakery.Oven.NewMacaroon(
 		p.Context,
 		httpbakery.RequestVersion(p.Request),
-		time.Now().Add(dischargeTokenDuration),
+		expiry,
 		[]checkers.Caveat{
 			idmclient.UserDeclaration(string(r.Username)),
 		},
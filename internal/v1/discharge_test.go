@@ -0,0 +1,127 @@
+// Copyright 2016 Canonical Ltd.
+
+package v1
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+
+	"github.com/CanonicalLtd/blues-identity/internal/identity"
+)
+
+func TestDispatchCaveatCheckerRejectsUnknownCondition(t *testing.T) {
+	_, err := dispatchCaveatChecker(context.Background(), nil, "require-2fa", nil, "", nil)
+	if errgo.Cause(err) != checkers.ErrCaveatNotRecognized {
+		t.Fatalf("err = %v, want checkers.ErrCaveatNotRecognized", err)
+	}
+}
+
+func TestDispatchCaveatCheckerPropagatesCheckerError(t *testing.T) {
+	wantErr := errgo.New("2fa required but not provided")
+	checkerMap := map[string]identity.CaveatChecker{
+		"require-2fa": func(ctx context.Context, who bakery.ACLIdentity, args string, req *http.Request) ([]checkers.Caveat, error) {
+			return nil, wantErr
+		},
+	}
+	_, err := dispatchCaveatChecker(context.Background(), checkerMap, "require-2fa", nil, "", nil)
+	if errgo.Cause(err) != wantErr {
+		t.Fatalf("err cause = %v, want %v", errgo.Cause(err), wantErr)
+	}
+}
+
+func TestDispatchCaveatCheckerReturnsRegisteredCaveats(t *testing.T) {
+	checkerMap := map[string]identity.CaveatChecker{
+		"require-2fa": func(ctx context.Context, who bakery.ACLIdentity, args string, req *http.Request) ([]checkers.Caveat, error) {
+			return []checkers.Caveat{{Condition: "require-2fa " + args}}, nil
+		},
+	}
+	cavs, err := dispatchCaveatChecker(context.Background(), checkerMap, "require-2fa", nil, "webauthn", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cavs) != 1 || cavs[0].Condition != "require-2fa webauthn" {
+		t.Fatalf("unexpected caveats: %#v", cavs)
+	}
+}
+
+func TestDischargeExpiryDefaultsWhenNoTokens(t *testing.T) {
+	before := time.Now()
+	got, err := dischargeExpiry("", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after := time.Now()
+	if got.Before(before.Add(time.Hour)) || got.After(after.Add(time.Hour)) {
+		t.Fatalf("expiry %v not within expected range around now+1h", got)
+	}
+}
+
+func TestDischargeExpiryClampsToLTE(t *testing.T) {
+	lte := time.Now().Add(10 * time.Minute).UTC().Truncate(time.Second)
+	got, err := dischargeExpiry("discharge-expiry-lte="+lte.Format(time.RFC3339), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(lte) {
+		t.Fatalf("expiry = %v, want %v", got, lte)
+	}
+}
+
+func TestDischargeExpiryClampsToMaxDuration(t *testing.T) {
+	before := time.Now()
+	got, err := dischargeExpiry("discharge-max-duration=5m", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after := time.Now()
+	if got.Before(before.Add(5*time.Minute)) || got.After(after.Add(5*time.Minute)) {
+		t.Fatalf("expiry %v not within expected range around now+5m", got)
+	}
+}
+
+func TestDischargeExpiryComposesMultipleTokensTakingMinimum(t *testing.T) {
+	lte := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	got, err := dischargeExpiry(
+		"discharge-expiry-lte="+lte.Format(time.RFC3339)+" discharge-max-duration=5m",
+		24*time.Hour,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// discharge-max-duration (now+5m) is earlier than discharge-expiry-lte
+	// (now+2h), so it should win.
+	if got.After(time.Now().Add(10 * time.Minute)) {
+		t.Fatalf("expiry %v did not take the earlier of the two bounds", got)
+	}
+}
+
+func TestDischargeExpiryRejectsPastLTE(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	if _, err := dischargeExpiry("discharge-expiry-lte="+past, time.Hour); err == nil {
+		t.Fatalf("expected an error for a past discharge-expiry-lte, got nil")
+	}
+}
+
+func TestDischargeExpiryRejectsMalformedToken(t *testing.T) {
+	if _, err := dischargeExpiry("discharge-expiry-lte=not-a-time", time.Hour); err == nil {
+		t.Fatalf("expected an error for a malformed discharge-expiry-lte, got nil")
+	}
+}
+
+func TestDischargeExpiryIgnoresUnrelatedTokens(t *testing.T) {
+	before := time.Now()
+	got, err := dischargeExpiry("some-other-token", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after := time.Now()
+	if got.Before(before.Add(time.Hour)) || got.After(after.Add(time.Hour)) {
+		t.Fatalf("expiry %v not within expected range around now+1h", got)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Canonical Ltd.
+
+package v1
+
+import (
+	"github.com/juju/httprequest"
+	"github.com/juju/idmclient/params"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+
+	"github.com/CanonicalLtd/blues-identity/internal/store"
+)
+
+// localLoginRequest is the request sent to exchange a local username
+// and password for a macaroon that can discharge an
+// is-authenticated-user caveat without contacting any external
+// identity provider.
+type localLoginRequest struct {
+	httprequest.Route `httprequest:"POST /v1/local-login"`
+	Body              localLoginBody `httprequest:",body"`
+}
+
+// localLoginBody holds the body of a localLoginRequest.
+type localLoginBody struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// localLoginResponse holds the response from the local-login
+// endpoint.
+type localLoginResponse struct {
+	Macaroon *bakery.Macaroon
+}
+
+// LocalLogin serves an HTTP endpoint that exchanges a username and
+// password for a local-login macaroon. This allows Candid to be used
+// in environments where no external identity provider is reachable.
+func (h *handler) LocalLogin(p httprequest.Params, r *localLoginRequest) (localLoginResponse, error) {
+	m, err := h.params.Authorizer.CreateLocalLoginMacaroon(
+		p.Context,
+		h.store,
+		httpbakery.RequestVersion(p.Request),
+		r.Body.Username,
+		r.Body.Password,
+	)
+	if h.params.Metrics != nil {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		h.params.Metrics.ObserveLogin("local", outcome)
+	}
+	if err != nil {
+		return localLoginResponse{}, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrUnauthorized))
+	}
+	return localLoginResponse{Macaroon: m}, nil
+}
+
+// setPasswordRequest is the request sent to set or replace a user's
+// local-login password. This is an admin-only operation.
+type setPasswordRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/password"`
+	Username          params.Username `httprequest:",path"`
+	Body              setPasswordBody `httprequest:",body"`
+}
+
+// setPasswordBody holds the body of a setPasswordRequest.
+type setPasswordBody struct {
+	Password string `json:"password"`
+}
+
+// SetPassword serves an HTTP endpoint that sets or replaces the
+// local-login password for a user.
+func (h *handler) SetPassword(p httprequest.Params, r *setPasswordRequest) error {
+	if _, err := h.store.Authorize(p.Context, p.Request, store.GlobalOp(store.ActionSetPassword)); err != nil {
+		return errgo.Mask(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(r.Body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return errgo.Notef(err, "cannot hash password")
+	}
+	if err := h.store.SetPassword(r.Username, hash); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+// hasPasswordRequest is the request sent to check whether a user has
+// a local-login password set. This is an admin-only operation.
+type hasPasswordRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/password"`
+	Username          params.Username `httprequest:",path"`
+}
+
+// hasPasswordResponse holds the response from the HasPassword
+// endpoint.
+type hasPasswordResponse struct {
+	// Set reports whether the user has a local-login password set.
+	Set bool `json:"set"`
+}
+
+// HasPassword serves an HTTP endpoint that reports whether a user has
+// local-login access, without revealing the password hash itself.
+func (h *handler) HasPassword(p httprequest.Params, r *hasPasswordRequest) (hasPasswordResponse, error) {
+	if _, err := h.store.Authorize(p.Context, p.Request, store.GlobalOp(store.ActionSetPassword)); err != nil {
+		return hasPasswordResponse{}, errgo.Mask(err)
+	}
+	_, err := h.store.PasswordHash(r.Username)
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return hasPasswordResponse{Set: false}, nil
+		}
+		return hasPasswordResponse{}, errgo.Mask(err)
+	}
+	return hasPasswordResponse{Set: true}, nil
+}
+
+// removePasswordRequest is the request sent to remove a user's
+// local-login password, disabling local login for that user. This is
+// an admin-only operation.
+type removePasswordRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/password"`
+	Username          params.Username `httprequest:",path"`
+}
+
+// RemovePassword serves an HTTP endpoint that removes local-login
+// access for a user.
+func (h *handler) RemovePassword(p httprequest.Params, r *removePasswordRequest) error {
+	if _, err := h.store.Authorize(p.Context, p.Request, store.GlobalOp(store.ActionSetPassword)); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := h.store.SetPassword(r.Username, nil); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
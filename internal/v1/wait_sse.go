@@ -0,0 +1,80 @@
+// Copyright 2016 Canonical Ltd.
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/juju/httprequest"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+)
+
+// waitSSEHeartbeat is the interval at which WaitSSE sends a "pending"
+// event to keep the connection alive while a rendezvous is still
+// outstanding.
+const waitSSEHeartbeat = 15 * time.Second
+
+// waitSSERequest is the request sent to the server to wait for logins
+// to complete via Server-Sent Events, as an alternative to polling
+// /v1/wait and /v1/wait-token.
+type waitSSERequest struct {
+	httprequest.Route `httprequest:"GET /v1/wait-sse"`
+	WaitID            string `httprequest:"waitid,form"`
+}
+
+// WaitSSE serves an HTTP endpoint that waits until a macaroon has been
+// discharged, emitting a "pending" heartbeat every 15 seconds and a
+// final "done" event carrying the waitResponse as JSON once the
+// rendezvous completes. This lets browser clients avoid polling
+// /v1/wait. As with Wait and WaitToken, the underlying rendezvous is
+// only ever consumed once.
+func (h *dischargeHandler) WaitSSE(p httprequest.Params, w *waitSSERequest) {
+	if w.WaitID == "" {
+		http.Error(p.Response, "wait id parameter not found", http.StatusBadRequest)
+		return
+	}
+	p.Response.Header().Set("Content-Type", "text/event-stream")
+	p.Response.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := p.Response.(http.Flusher)
+	for {
+		ctx, cancel := context.WithTimeout(p.Context, waitSSEHeartbeat)
+		item, result, err := h.place.Wait(ctx, w.WaitID)
+		cancel()
+		if errgo.Cause(err) == context.DeadlineExceeded {
+			writeSSEEvent(p.Response, flusher, "pending", nil)
+			if p.Context.Err() != nil {
+				// The client has gone away.
+				return
+			}
+			continue
+		}
+		if err != nil {
+			writeSSEEvent(p.Response, flusher, "error", errgo.Notef(err, "cannot wait").Error())
+			return
+		}
+		resp, err := h.completeWait(p, item.(*dischargeRequestInfo), result.(loginInfo))
+		if err != nil {
+			writeSSEEvent(p.Response, flusher, "error", err.Error())
+			return
+		}
+		writeSSEEvent(p.Response, flusher, "done", resp)
+		return
+	}
+}
+
+// writeSSEEvent writes a single Server-Sent Event of the given type
+// with data marshalled as JSON, flushing it immediately if possible.
+func writeSSEEvent(w http.ResponseWriter, flusher http.Flusher, event string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		body = []byte(`{}`)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Canonical Ltd.
+
+// Package meeting implements a rendezvous point that lets one HTTP
+// request (a browser completing an interactive login) hand off a
+// result to another (whichever of /v1/wait, /v1/wait-token or
+// /v1/wait-sse is waiting for it), without the two requests needing a
+// direct connection to each other.
+package meeting
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+)
+
+// Place holds a set of rendezvous that are currently in progress. The
+// zero value is not usable; use NewPlace.
+type Place struct {
+	mu         sync.Mutex
+	rendezvous map[string]*rendezvous
+}
+
+// rendezvous holds the state of a single outstanding wait id.
+type rendezvous struct {
+	// item is the value passed to NewRendezvous, returned unchanged
+	// to whoever completes the wait.
+	item interface{}
+
+	// done is closed by Done once the rendezvous has completed.
+	done chan struct{}
+
+	// closed records whether done has already been closed, guarded by
+	// Place.mu so that two concurrent Done calls for the same id can't
+	// both close done and panic.
+	closed bool
+
+	// result and err are set by Done before done is closed.
+	result interface{}
+	err    error
+
+	// created records when the rendezvous was registered, so GC can
+	// identify abandoned ones.
+	created time.Time
+}
+
+// NewPlace returns a new Place with no rendezvous in progress.
+func NewPlace() *Place {
+	return &Place{
+		rendezvous: make(map[string]*rendezvous),
+	}
+}
+
+// NewRendezvous registers a new rendezvous holding item, which is
+// opaque to Place and returned unchanged by Wait, and returns an
+// opaque wait id by which Done and Wait refer to it.
+func (p *Place) NewRendezvous(item interface{}) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", errgo.Notef(err, "cannot generate rendezvous id")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rendezvous[id] = &rendezvous{
+		item:    item,
+		done:    make(chan struct{}),
+		created: time.Now(),
+	}
+	return id, nil
+}
+
+// Done completes the rendezvous identified by id, waking any
+// goroutines currently blocked in Wait for that id. It is a no-op if
+// the rendezvous has already completed, or has been GC'd after being
+// abandoned for too long.
+func (p *Place) Done(id string, result interface{}, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.rendezvous[id]
+	if !ok || r.closed {
+		// Already completed (or never existed); the first call wins.
+		return
+	}
+	r.result = result
+	r.err = err
+	r.closed = true
+	close(r.done)
+}
+
+// Wait blocks until the rendezvous identified by id completes, or ctx
+// is done, whichever happens first. On success it returns the item
+// passed to NewRendezvous and the result passed to Done; if ctx is
+// done first it returns ctx.Err(), leaving the rendezvous in place so
+// that a later call to Wait (for example from /v1/wait-token) can
+// still pick it up. Once a rendezvous actually completes, the first
+// call to observe that removes it, so it is safe for several
+// endpoints to race to Wait on the same id.
+func (p *Place) Wait(ctx context.Context, id string) (item interface{}, result interface{}, err error) {
+	p.mu.Lock()
+	r, ok := p.rendezvous[id]
+	p.mu.Unlock()
+	if !ok {
+		return nil, nil, errgo.Newf("unknown wait id %q", id)
+	}
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	if !p.remove(id) {
+		return nil, nil, errgo.Newf("wait id %q already consumed", id)
+	}
+	return r.item, r.result, r.err
+}
+
+// remove deletes the rendezvous identified by id, reporting whether it
+// was still present.
+func (p *Place) remove(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.rendezvous[id]; !ok {
+		return false
+	}
+	delete(p.rendezvous, id)
+	return true
+}
+
+// GC removes any rendezvous that were registered more than maxAge ago
+// and have not been collected since, whether or not they ever
+// completed. This bounds the memory used by rendezvous whose browser
+// tab was abandoned, and whose resume token will never be used again.
+func (p *Place) GC(maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, r := range p.rendezvous {
+		if r.created.Before(cutoff) {
+			delete(p.rendezvous, id)
+		}
+	}
+}
+
+// Len returns the number of rendezvous currently in progress. It
+// implements monitoring.RendezvousCounter.
+func (p *Place) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.rendezvous)
+}
+
+// newId returns a new random wait id, URL-safe so it can be used
+// directly as a query parameter.
+func newId() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(buf), nil
+}
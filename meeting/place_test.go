@@ -0,0 +1,138 @@
+// Copyright 2016 Canonical Ltd.
+
+package meeting
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWaitReturnsItemAndResultAfterDone(t *testing.T) {
+	p := NewPlace()
+	id, err := p.NewRendezvous("the-item")
+	if err != nil {
+		t.Fatalf("cannot make rendezvous: %v", err)
+	}
+	go p.Done(id, "the-result", nil)
+
+	item, result, err := p.Wait(context.Background(), id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if item.(string) != "the-item" {
+		t.Fatalf("item = %q, want %q", item, "the-item")
+	}
+	if result.(string) != "the-result" {
+		t.Fatalf("result = %q, want %q", result, "the-result")
+	}
+}
+
+func TestWaitPropagatesDoneError(t *testing.T) {
+	p := NewPlace()
+	id, err := p.NewRendezvous(nil)
+	if err != nil {
+		t.Fatalf("cannot make rendezvous: %v", err)
+	}
+	wantErr := errNotFoundForTest{}
+	go p.Done(id, nil, wantErr)
+
+	_, _, err = p.Wait(context.Background(), id)
+	if err != wantErr {
+		t.Fatalf("err = %v, want %v", err, wantErr)
+	}
+}
+
+type errNotFoundForTest struct{}
+
+func (errNotFoundForTest) Error() string { return "not found" }
+
+func TestWaitTimesOutWithoutConsumingRendezvous(t *testing.T) {
+	p := NewPlace()
+	id, err := p.NewRendezvous("item")
+	if err != nil {
+		t.Fatalf("cannot make rendezvous: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = p.Wait(ctx, id)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if p.Len() != 1 {
+		t.Fatalf("rendezvous was consumed by a timed-out Wait; Len() = %d, want 1", p.Len())
+	}
+
+	// A second Wait (as /v1/wait-token would issue) can still complete
+	// it.
+	go p.Done(id, "result", nil)
+	_, result, err := p.Wait(context.Background(), id)
+	if err != nil {
+		t.Fatalf("unexpected error resuming wait: %v", err)
+	}
+	if result.(string) != "result" {
+		t.Fatalf("result = %q, want %q", result, "result")
+	}
+}
+
+func TestWaitUnknownIdReturnsError(t *testing.T) {
+	p := NewPlace()
+	if _, _, err := p.Wait(context.Background(), "no-such-id"); err == nil {
+		t.Fatalf("expected an error for an unknown wait id")
+	}
+}
+
+func TestConcurrentDoneDoesNotPanic(t *testing.T) {
+	p := NewPlace()
+	id, err := p.NewRendezvous("item")
+	if err != nil {
+		t.Fatalf("cannot make rendezvous: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.Done(id, i, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	_, result, err := p.Wait(context.Background(), id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := result.(int); !ok {
+		t.Fatalf("result = %#v, want an int from one of the racing Done calls", result)
+	}
+}
+
+func TestGCRemovesOnlyAbandonedRendezvous(t *testing.T) {
+	p := NewPlace()
+	oldId, err := p.NewRendezvous("old")
+	if err != nil {
+		t.Fatalf("cannot make rendezvous: %v", err)
+	}
+	p.rendezvous[oldId].created = time.Now().Add(-time.Hour)
+
+	freshId, err := p.NewRendezvous("fresh")
+	if err != nil {
+		t.Fatalf("cannot make rendezvous: %v", err)
+	}
+
+	p.GC(time.Minute)
+
+	if p.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1 after GC", p.Len())
+	}
+	if _, _, err := p.Wait(context.Background(), oldId); err == nil {
+		t.Fatalf("expected the abandoned rendezvous to have been GC'd")
+	}
+	go p.Done(freshId, "still here", nil)
+	if _, _, err := p.Wait(context.Background(), freshId); err != nil {
+		t.Fatalf("expected the fresh rendezvous to survive GC: %v", err)
+	}
+}